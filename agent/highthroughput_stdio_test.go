@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeVsockAgent is a fakeAgent that also implements VsockStdioAgent,
+// handing back real local listeners (TCP, in place of vsock ports, or Unix
+// sockets) addressed with the "network:address" encoding
+// AllocateStdioVsock's doc comment specifies, so HighThroughputStdio's
+// actual dial/wiring logic can be exercised end to end (rather than only its
+// ErrVsockUnavailable fallback path).
+type fakeVsockAgent struct {
+	fakeAgent
+	stdin, stdout, stderr net.Listener
+}
+
+func (a *fakeVsockAgent) AllocateStdioVsock(container, process string) (stdin, stdout, stderr string, err error) {
+	return a.stdin.Addr().Network() + ":" + a.stdin.Addr().String(),
+		a.stdout.Addr().Network() + ":" + a.stdout.Addr().String(),
+		a.stderr.Addr().Network() + ":" + a.stderr.Addr().String(),
+		nil
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	return l
+}
+
+func listenUnix(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("unix", t.TempDir()+"/stdio.sock")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	return l
+}
+
+// TestHighThroughputStdioDialsAllocatedPorts asserts that, given an agent
+// that implements VsockStdioAgent, HighThroughputStdio dials every address
+// AllocateStdioVsock returns and the resulting pipes actually carry bytes
+// to/from those listeners. No agent in this tree implements
+// VsockStdioAgent yet (see its doc comment), so this is the only coverage
+// of the dial path beyond the ErrVsockUnavailable fallback.
+func TestHighThroughputStdioDialsAllocatedPorts(t *testing.T) {
+	stdinL, stdoutL, stderrL := listen(t), listen(t), listen(t)
+	defer stdinL.Close()
+	defer stdoutL.Close()
+	defer stderrL.Close()
+
+	stdinRecv := make(chan string, 1)
+	go func() {
+		conn, err := stdinL.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, len("ping"))
+		io.ReadFull(conn, buf)
+		stdinRecv <- string(buf)
+	}()
+	go func() {
+		conn, err := stdoutL.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "out")
+	}()
+	go func() {
+		conn, err := stderrL.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "err")
+	}()
+
+	a := &fakeVsockAgent{stdin: stdinL, stdout: stdoutL, stderr: stderrL}
+	in, out, errOut, err := HighThroughputStdio(a, "c", "p")
+	if err != nil {
+		t.Fatalf("HighThroughputStdio: %v", err)
+	}
+	defer in.Close()
+
+	if _, err := in.Write([]byte("ping")); err != nil {
+		t.Fatalf("write stdin: %v", err)
+	}
+	if got := <-stdinRecv; got != "ping" {
+		t.Fatalf("stdin listener received %q, want %q", got, "ping")
+	}
+
+	outBuf := make([]byte, len("out"))
+	if _, err := io.ReadFull(out, outBuf); err != nil {
+		t.Fatalf("read stdout: %v", err)
+	}
+	if string(outBuf) != "out" {
+		t.Fatalf("stdout = %q, want %q", outBuf, "out")
+	}
+
+	errBuf := make([]byte, len("err"))
+	if _, err := io.ReadFull(errOut, errBuf); err != nil {
+		t.Fatalf("read stderr: %v", err)
+	}
+	if string(errBuf) != "err" {
+		t.Fatalf("stderr = %q, want %q", errBuf, "err")
+	}
+}
+
+// TestHighThroughputStdioUnavailable asserts the plain fallback behavior for
+// an agent that doesn't implement VsockStdioAgent at all.
+func TestHighThroughputStdioUnavailable(t *testing.T) {
+	if _, _, _, err := HighThroughputStdio(fakeAgent{}, "c", "p"); err != ErrVsockUnavailable {
+		t.Fatalf("err = %v, want ErrVsockUnavailable", err)
+	}
+}
+
+// TestHighThroughputStdioDialsUnixSockets asserts that a "unix:"-addressed
+// stdio endpoint (the proxied-Unix-socket form VsockStdioAgent's doc comment
+// describes) is dialed as a Unix socket, not assumed to be tcp.
+func TestHighThroughputStdioDialsUnixSockets(t *testing.T) {
+	stdinL, stdoutL, stderrL := listenUnix(t), listenUnix(t), listenUnix(t)
+	defer stdinL.Close()
+	defer stdoutL.Close()
+	defer stderrL.Close()
+
+	go func() {
+		conn, err := stdoutL.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "out")
+	}()
+
+	a := &fakeVsockAgent{stdin: stdinL, stdout: stdoutL, stderr: stderrL}
+	in, out, _, err := HighThroughputStdio(a, "c", "p")
+	if err != nil {
+		t.Fatalf("HighThroughputStdio: %v", err)
+	}
+	defer in.Close()
+
+	outBuf := make([]byte, len("out"))
+	if _, err := io.ReadFull(out, outBuf); err != nil {
+		t.Fatalf("read stdout: %v", err)
+	}
+	if string(outBuf) != "out" {
+		t.Fatalf("stdout = %q, want %q", outBuf, "out")
+	}
+}
+
+// TestDialStdioAddrRejectsRawVsockAndUnknownNetworks asserts dialStdioAddr
+// fails loudly instead of silently misdialing addresses it can't actually
+// reach: a bare vsock "cid:port" pair (not dialable without an AF_VSOCK
+// dialer wired in) and a network it doesn't recognize at all.
+func TestDialStdioAddrRejectsRawVsockAndUnknownNetworks(t *testing.T) {
+	if _, err := dialStdioAddr("vsock:3:1024"); err == nil {
+		t.Fatalf("dialStdioAddr(vsock:3:1024) = nil error, want an error (raw vsock isn't dialable yet)")
+	}
+	if _, err := dialStdioAddr("sctp:127.0.0.1:1024"); err == nil {
+		t.Fatalf("dialStdioAddr(sctp:...) = nil error, want an error (unknown network)")
+	}
+	if _, err := dialStdioAddr("no-network-prefix"); err == nil {
+		t.Fatalf("dialStdioAddr with no \"network:\" prefix = nil error, want an error")
+	}
+}
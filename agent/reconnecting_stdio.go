@@ -0,0 +1,359 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// stdioRingSize bounds how much recently-written stdin is retained so it can
+// be replayed to the agent after a reconnect without the caller having to
+// resend anything itself.
+const stdioRingSize = 64 * 1024
+
+// stdinRing is a fixed-size tail buffer of the bytes most recently written to
+// a container's stdin, indexed by the absolute stream offset so callers can
+// ask "what did I send since offset N".
+type stdinRing struct {
+	mu   sync.Mutex
+	buf  []byte
+	size int
+	next int64 // absolute offset of the next byte that will be appended
+}
+
+func newStdinRing(size int) *stdinRing {
+	return &stdinRing{size: size}
+}
+
+func (r *stdinRing) Write(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = append(r.buf, p...)
+	if over := len(r.buf) - r.size; over > 0 {
+		r.buf = r.buf[over:]
+	}
+	r.next += int64(len(p))
+}
+
+// since returns the bytes written at or after offset, or ok=false if offset
+// has already fallen out of the ring and can't be replayed.
+func (r *stdinRing) since(offset int64) (p []byte, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	start := r.next - int64(len(r.buf))
+	if offset < start || offset > r.next {
+		return nil, false
+	}
+	return r.buf[offset-start:], true
+}
+
+// nextOffset returns the absolute offset of the next byte that Write will
+// append, i.e. how much has been handed to WriteStdin so far.
+func (r *stdinRing) nextOffset() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.next
+}
+
+// dialFunc opens a fresh kata-agent.sock connection and wires up its stdio
+// pipes, resuming stdout/stderr from the given offsets when the agent
+// supports it (see ResumableStdioAgent). It's a field on ReconnectingStdio
+// rather than a direct call so tests can simulate a dropped connection
+// without a real kata-agent.sock.
+type dialFunc func(sockPath, container, process string, stdoutOffset, stderrOffset int64) (SandboxAgent, io.WriteCloser, io.Reader, io.Reader, error)
+
+// ResumableStdioAgent is implemented by agents that can resume delivering
+// stdout/stderr from a specific byte offset instead of restarting the stream
+// from scratch, which is what's needed for a reconnect to not drop or
+// duplicate output. Agents that don't implement it get a plain StdioPipe, so
+// a reconnect is still possible but stdout/stderr restart from whatever the
+// fresh pipe yields.
+//
+// No agent in this tree implements it yet, so in practice every reconnect
+// currently falls back to the StdioPipe branch in stdioFromAgent below; the
+// offset plumbing here lands ahead of that agent-side support so a real
+// implementation only needs to satisfy this interface.
+type ResumableStdioAgent interface {
+	SandboxAgent
+	StdioPipeAt(container, process string, stdoutOffset, stderrOffset int64) (io.WriteCloser, io.Reader, io.Reader, error)
+}
+
+// stdioFromAgent wires up a's stdio pipes for container/process, resuming
+// stdout/stderr from the given offsets if a implements ResumableStdioAgent.
+// It's split out from defaultDial so the offset-dispatch logic can be tested
+// against a fake agent without a real kata-agent.sock connection.
+func stdioFromAgent(a SandboxAgent, container, process string, stdoutOffset, stderrOffset int64) (io.WriteCloser, io.Reader, io.Reader, error) {
+	if ra, ok := a.(ResumableStdioAgent); ok {
+		return ra.StdioPipeAt(container, process, stdoutOffset, stderrOffset)
+	}
+	if stdoutOffset != 0 || stderrOffset != 0 {
+		// This is a reconnect after some output was already delivered
+		// (a reconnect before any output passes offsets of 0 and is not
+		// logged here), and a doesn't implement ResumableStdioAgent, so the fresh
+		// StdioPipe below starts wherever the container's output currently
+		// is: any bytes produced while no connection was attached are
+		// silently and permanently lost. This is loud, not a source
+		// comment, because it's a real data-loss event, not a cosmetic one.
+		glog.Warningf("reconnecting stdio for %s/%s: agent %T does not implement ResumableStdioAgent; stdout/stderr are resuming from a fresh pipe and any output produced while disconnected has been lost", container, process, a)
+	}
+	in, out, errOut := StdioPipe(a, container, process)
+	return in, out, errOut, nil
+}
+
+func defaultDial(sockPath, container, process string, stdoutOffset, stderrOffset int64) (SandboxAgent, io.WriteCloser, io.Reader, io.Reader, error) {
+	a, err := NewKataAgent(sockPath)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	in, out, errOut, err := stdioFromAgent(a, container, process, stdoutOffset, stderrOffset)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return a, in, out, errOut, nil
+}
+
+// ReconnectingStdio proxies stdin/stdout/stderr to a container process over a
+// kata-agent.sock connection that may be re-established transparently if it
+// drops mid-session. It keeps the last stdioRingSize bytes of stdin so they
+// can be replayed after a reconnect, and tracks how many stdout/stderr bytes
+// have been delivered so a caller can resume a session rather than restart
+// it from nothing.
+type ReconnectingStdio struct {
+	sockPath, container, process string
+	dial                         dialFunc
+
+	// reconnectMu serializes Reconnect so the stdin, stdout and stderr
+	// copy loops, which each notice the same dropped connection and call
+	// Reconnect independently, collapse into a single redial and stdin
+	// replay instead of each racing their own (see Reconnect/Generation).
+	reconnectMu sync.Mutex
+
+	mu          sync.Mutex
+	agent       SandboxAgent
+	in          io.WriteCloser
+	out, errOut io.Reader
+	// generation counts successful (re)dials; Reconnect uses it to detect
+	// that another caller already redialed on its behalf.
+	generation int64
+
+	stdinRing *stdinRing
+	// ackedStdin is the stdinRing offset that the most recently (re)dialed
+	// connection is known to have received, i.e. everything since it is
+	// unacknowledged and must be replayed if the connection drops again.
+	// The kata-agent protocol has no byte-level ack, so a fresh dial only
+	// "acks" up to the point a subsequent reconnect has finished replaying.
+	ackedStdin int64
+
+	stdoutOffset int64
+	stderrOffset int64
+}
+
+// NewReconnectingStdio dials sockPath and wires up the stdio pipes for
+// container/process, resuming stdout/stderr accounting from offset (0 for a
+// fresh session).
+func NewReconnectingStdio(sockPath, container, process string, offset int64) (*ReconnectingStdio, error) {
+	r := &ReconnectingStdio{
+		sockPath:     sockPath,
+		container:    container,
+		process:      process,
+		dial:         defaultDial,
+		stdinRing:    newStdinRing(stdioRingSize),
+		stdoutOffset: offset,
+		stderrOffset: offset,
+	}
+	if err := r.redial(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// closeConn tears down one dialed connection's agent/stdio handles; shared
+// by redial (closing the connection it's replacing) and Close (closing the
+// current one for good).
+func closeConn(a SandboxAgent, in io.WriteCloser, out, errOut io.Reader) error {
+	var err error
+	if c, ok := a.(io.Closer); ok {
+		err = c.Close()
+	}
+	if in != nil {
+		if e := in.Close(); err == nil {
+			err = e
+		}
+	}
+	if c, ok := out.(io.Closer); ok {
+		c.Close()
+	}
+	if c, ok := errOut.(io.Closer); ok {
+		c.Close()
+	}
+	return err
+}
+
+// redial opens a new connection via r.dial, resuming stdout/stderr from the
+// offsets this session has already delivered, and closes the connection it
+// replaces so a flapping agent doesn't leak one dead connection per
+// reconnect.
+func (r *ReconnectingStdio) redial() error {
+	r.mu.Lock()
+	stdoutOffset, stderrOffset := r.stdoutOffset, r.stderrOffset
+	r.mu.Unlock()
+
+	a, in, out, errOut, err := r.dial(r.sockPath, r.container, r.process, stdoutOffset, stderrOffset)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	oldAgent, oldIn, oldOut, oldErrOut := r.agent, r.in, r.out, r.errOut
+	r.agent, r.in, r.out, r.errOut = a, in, out, errOut
+	r.generation++
+	r.mu.Unlock()
+
+	if oldAgent != nil {
+		if err := closeConn(oldAgent, oldIn, oldOut, oldErrOut); err != nil {
+			glog.Warningf("reconnecting stdio for %s/%s: closing the replaced connection: %v", r.container, r.process, err)
+		}
+	}
+	return nil
+}
+
+// Generation returns a token identifying the current connection. A caller
+// that's about to copy from/to the stream should note it beforehand and
+// pass it to Reconnect once that stream errors, so that if some other
+// caller (stdin vs. stdout vs. stderr) already redialed in the meantime,
+// this one doesn't also redial and replay stdin a second time.
+func (r *ReconnectingStdio) Generation() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.generation
+}
+
+// Reconnect re-dials the agent with exponential backoff (capped at 5s),
+// replays any stdin bytes that were written but not yet acknowledged, and
+// returns once a new connection is in place. It stops redialing only when
+// stopc is closed; an error writing the replayed stdin to the new connection
+// is returned to the caller.
+//
+// observedGeneration is the Generation() the caller saw on the connection
+// that just errored. If the current generation has already moved past it by
+// the time Reconnect acquires reconnectMu, some other caller raced it and
+// already did the redial and replay for this drop, so Reconnect is a no-op:
+// without this, the stdout and stderr copy loops (which notice the same
+// dropped connection independently) would each redial, leaking one
+// connection and replaying unacked stdin twice.
+func (r *ReconnectingStdio) Reconnect(stopc <-chan struct{}, observedGeneration int64) error {
+	r.reconnectMu.Lock()
+	defer r.reconnectMu.Unlock()
+
+	if r.Generation() != observedGeneration {
+		return nil
+	}
+
+	backoff := 100 * time.Millisecond
+	const maxBackoff = 5 * time.Second
+	for {
+		select {
+		case <-stopc:
+			return errors.New("reconnecting stdio: stopped before a connection could be re-established")
+		default:
+		}
+
+		err := r.redial()
+		if err == nil {
+			break
+		}
+		glog.Warningf("reconnecting stdio for %s/%s: dial failed: %v, retrying in %s", r.container, r.process, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-stopc:
+			return errors.New("reconnecting stdio: stopped before a connection could be re-established")
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	r.mu.Lock()
+	acked := r.ackedStdin
+	in := r.in
+	r.mu.Unlock()
+
+	if unacked, ok := r.stdinRing.since(acked); ok && len(unacked) > 0 {
+		if _, err := in.Write(unacked); err != nil {
+			return err
+		}
+	}
+
+	// The new connection has now seen everything written up to this point,
+	// so mark it acknowledged; anything written after this is unacked again
+	// until the next reconnect.
+	r.mu.Lock()
+	r.ackedStdin = r.stdinRing.nextOffset()
+	r.mu.Unlock()
+	return nil
+}
+
+// WriteStdin sends p to the container's stdin, recording it in the replay
+// ring first so it can be resent if the connection drops before the agent
+// has acknowledged it via a subsequent reconnect.
+func (r *ReconnectingStdio) WriteStdin(p []byte) (int, error) {
+	r.stdinRing.Write(p)
+	r.mu.Lock()
+	in := r.in
+	r.mu.Unlock()
+	return in.Write(p)
+}
+
+// CloseStdin closes the container's stdin on the current connection.
+func (r *ReconnectingStdio) CloseStdin() error {
+	r.mu.Lock()
+	a := r.agent
+	r.mu.Unlock()
+	return a.CloseStdin(r.container, r.process)
+}
+
+// Close tears down the current connection so any goroutine blocked reading
+// or writing it unblocks with an error instead of hanging; used when the
+// caller is detaching deliberately and no longer wants a reconnect to
+// happen.
+func (r *ReconnectingStdio) Close() error {
+	r.mu.Lock()
+	agent, in, out, errOut := r.agent, r.in, r.out, r.errOut
+	r.mu.Unlock()
+
+	return closeConn(agent, in, out, errOut)
+}
+
+// Stdout returns the current connection's stdout reader and the number of
+// bytes already delivered to the caller from previous connections.
+func (r *ReconnectingStdio) Stdout() (io.Reader, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.out, r.stdoutOffset
+}
+
+// Stderr returns the current connection's stderr reader and the number of
+// bytes already delivered to the caller from previous connections.
+func (r *ReconnectingStdio) Stderr() (io.Reader, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.errOut, r.stderrOffset
+}
+
+// AddStdoutOffset advances the stdout byte counter by n, e.g. after the
+// caller has forwarded n more bytes to its own output.
+func (r *ReconnectingStdio) AddStdoutOffset(n int64) {
+	r.mu.Lock()
+	r.stdoutOffset += n
+	r.mu.Unlock()
+}
+
+// AddStderrOffset advances the stderr byte counter by n.
+func (r *ReconnectingStdio) AddStderrOffset(n int64) {
+	r.mu.Lock()
+	r.stderrOffset += n
+	r.mu.Unlock()
+}
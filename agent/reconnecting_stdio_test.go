@@ -0,0 +1,297 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeAgent is a minimal stand-in for the real kata-agent RPC client, just
+// enough of agent.SandboxAgent's surface for this test.
+type fakeAgent struct{}
+
+func (fakeAgent) SignalProcess(container, process string, sig syscall.Signal) error { return nil }
+func (fakeAgent) CloseStdin(container, process string) error                        { return nil }
+func (fakeAgent) WaitProcess(container, process string) int                         { return 0 }
+func (fakeAgent) TtyWinResize(container, process string, rows, cols uint16) error    { return nil }
+
+// fakeConn simulates one kata-agent.sock connection: bytes written by the
+// shim land in stdin; stdout is whatever the test feeds into stdoutW before
+// closing it (to simulate the agent dying mid-copy) or closing it cleanly
+// (to simulate a normal end of stream). It also counts Close calls so a
+// test can assert a superseded connection was actually torn down.
+type fakeConn struct {
+	mu      sync.Mutex
+	stdin   bytes.Buffer
+	stdoutW *io.PipeWriter
+	closes  int
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stdin.Write(p)
+}
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	c.closes++
+	c.mu.Unlock()
+	return c.stdoutW.Close()
+}
+
+func (c *fakeConn) stdinString() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stdin.String()
+}
+
+func (c *fakeConn) closeCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closes
+}
+
+// TestReconnectingStdioSurvivesMidCopyDisconnect kills the simulated agent
+// connection partway through a stdout copy and asserts the reconnected
+// session delivers the rest of the stream exactly once (no bytes lost or
+// duplicated), and that stdin written before the drop is replayed to the new
+// connection.
+//
+// dial here is hand-written to hand back the correct continuation on
+// reconnect, the way a ResumableStdioAgent would; it does not exercise
+// stdioFromAgent's fallback for agents that don't implement that interface
+// (see TestStdioFromAgentResumesViaResumableStdioAgent's doc comment and
+// stdioFromAgent's warning log), so it is not coverage for "no output lost
+// on reconnect" against the agent this tree actually dials today.
+func TestReconnectingStdioSurvivesMidCopyDisconnect(t *testing.T) {
+	var mu sync.Mutex
+	var conns []*fakeConn
+
+	dial := func(sockPath, container, process string, stdoutOffset, stderrOffset int64) (SandboxAgent, io.WriteCloser, io.Reader, io.Reader, error) {
+		pr, pw := io.Pipe()
+		conn := &fakeConn{stdoutW: pw}
+
+		mu.Lock()
+		conns = append(conns, conn)
+		n := len(conns)
+		mu.Unlock()
+
+		go func() {
+			if n == 1 {
+				// first connection: deliver a partial chunk, then die before
+				// the rest is sent, simulating an agent restart mid-copy.
+				io.WriteString(pw, "hello ")
+				pw.CloseWithError(io.ErrClosedPipe)
+			} else {
+				io.WriteString(pw, "world")
+				pw.Close()
+			}
+		}()
+
+		return fakeAgent{}, conn, pr, bytes.NewReader(nil), nil
+	}
+
+	r := &ReconnectingStdio{
+		sockPath:  "ignored",
+		container: "c",
+		process:   "p",
+		dial:      dial,
+		stdinRing: newStdinRing(stdioRingSize),
+	}
+	if err := r.redial(); err != nil {
+		t.Fatalf("initial dial: %v", err)
+	}
+
+	if _, err := r.WriteStdin([]byte("unacked-input")); err != nil {
+		t.Fatalf("write stdin: %v", err)
+	}
+
+	stopc := make(chan struct{})
+	out, _ := r.Stdout()
+	var got bytes.Buffer
+	buf := make([]byte, 64)
+	for got.Len() < len("hello world") {
+		gen := r.Generation()
+		n, err := out.Read(buf)
+		got.Write(buf[:n])
+		if err != nil {
+			if rErr := r.Reconnect(stopc, gen); rErr != nil {
+				t.Fatalf("reconnect: %v", rErr)
+			}
+			out, _ = r.Stdout()
+		}
+	}
+
+	if got.String() != "hello world" {
+		t.Fatalf("got %q, want %q (bytes lost or duplicated across reconnect)", got.String(), "hello world")
+	}
+
+	mu.Lock()
+	replayConn := conns[1]
+	mu.Unlock()
+	if replayed := replayConn.stdinString(); replayed != "unacked-input" {
+		t.Fatalf("stdin replayed to the new connection = %q, want %q", replayed, "unacked-input")
+	}
+}
+
+// TestRedialClosesSupersededConnection asserts that redialing tears down
+// the connection it's replacing: since Reconnect calls redial on every
+// transient socket error, failing to close the old connection would leak
+// one fd per reconnect against a flapping agent.
+func TestRedialClosesSupersededConnection(t *testing.T) {
+	var mu sync.Mutex
+	var conns []*fakeConn
+
+	dial := func(sockPath, container, process string, stdoutOffset, stderrOffset int64) (SandboxAgent, io.WriteCloser, io.Reader, io.Reader, error) {
+		pr, pw := io.Pipe()
+		conn := &fakeConn{stdoutW: pw}
+		mu.Lock()
+		conns = append(conns, conn)
+		mu.Unlock()
+		return fakeAgent{}, conn, pr, bytes.NewReader(nil), nil
+	}
+
+	r := &ReconnectingStdio{
+		sockPath:  "ignored",
+		container: "c",
+		process:   "p",
+		dial:      dial,
+		stdinRing: newStdinRing(stdioRingSize),
+	}
+	if err := r.redial(); err != nil {
+		t.Fatalf("initial dial: %v", err)
+	}
+	if err := r.redial(); err != nil {
+		t.Fatalf("second dial: %v", err)
+	}
+
+	mu.Lock()
+	first := conns[0]
+	mu.Unlock()
+	if got := first.closeCount(); got != 1 {
+		t.Fatalf("first connection closed %d times after being superseded, want 1 (leaked)", got)
+	}
+}
+
+// TestReconnectCollapsesConcurrentCallers simulates stdout and stderr both
+// noticing the same dropped connection and calling Reconnect at once: only
+// one of them should actually redial and replay stdin, and the other should
+// see the new generation and return immediately, rather than both racing
+// their own redial+replay of the same drop.
+func TestReconnectCollapsesConcurrentCallers(t *testing.T) {
+	var dials int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	dial := func(sockPath, container, process string, stdoutOffset, stderrOffset int64) (SandboxAgent, io.WriteCloser, io.Reader, io.Reader, error) {
+		n := atomic.AddInt32(&dials, 1)
+		if n == 2 {
+			// this is the redial triggered by the two racing Reconnect
+			// calls below; block it until the test releases it, so the
+			// other call reaches Reconnect while this redial is in flight
+			// (waiting on reconnectMu) or after it, and either way must
+			// find the generation already advanced.
+			close(started)
+			<-release
+		}
+		pr, pw := io.Pipe()
+		conn := &fakeConn{stdoutW: pw}
+		return fakeAgent{}, conn, pr, bytes.NewReader(nil), nil
+	}
+
+	r := &ReconnectingStdio{
+		sockPath:  "ignored",
+		container: "c",
+		process:   "p",
+		dial:      dial,
+		stdinRing: newStdinRing(stdioRingSize),
+	}
+	if err := r.redial(); err != nil {
+		t.Fatalf("initial dial: %v", err)
+	}
+	gen := r.Generation()
+
+	stopc := make(chan struct{})
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errc <- r.Reconnect(stopc, gen) }()
+	}
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the racing Reconnect calls to start redialing")
+	}
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("Reconnect: %v", err)
+		}
+	}
+
+	if got := atomic.LoadInt32(&dials); got != 2 {
+		t.Fatalf("dial called %d times, want 2 (one initial connect, one collapsed reconnect)", got)
+	}
+}
+
+// resumableFakeAgent is a fakeAgent that also implements ResumableStdioAgent,
+// recording the offsets it was asked to resume from so a test can assert
+// stdioFromAgent actually forwards them instead of always restarting the
+// stream from zero.
+type resumableFakeAgent struct {
+	fakeAgent
+	gotStdoutOffset, gotStderrOffset int64
+}
+
+func (a *resumableFakeAgent) StdioPipeAt(container, process string, stdoutOffset, stderrOffset int64) (io.WriteCloser, io.Reader, io.Reader, error) {
+	a.gotStdoutOffset, a.gotStderrOffset = stdoutOffset, stderrOffset
+	pr, pw := io.Pipe()
+	pw.Close()
+	return &fakeConn{stdoutW: pw}, pr, bytes.NewReader(nil), nil
+}
+
+// TestStdioFromAgentResumesViaResumableStdioAgent asserts that when the
+// dialed agent implements ResumableStdioAgent, stdioFromAgent calls
+// StdioPipeAt with the exact offsets a reconnect is resuming from, rather
+// than silently falling back to a fresh (non-resuming) StdioPipe. No agent
+// in this tree implements ResumableStdioAgent yet (see its doc comment), so
+// this is the only coverage of the resume path until one does.
+func TestStdioFromAgentResumesViaResumableStdioAgent(t *testing.T) {
+	a := &resumableFakeAgent{}
+	if _, _, _, err := stdioFromAgent(a, "c", "p", 42, 7); err != nil {
+		t.Fatalf("stdioFromAgent: %v", err)
+	}
+	if a.gotStdoutOffset != 42 || a.gotStderrOffset != 7 {
+		t.Fatalf("StdioPipeAt offsets = (%d, %d), want (42, 7)", a.gotStdoutOffset, a.gotStderrOffset)
+	}
+}
+
+// TestStdinRingBounded guards against the ring growing without bound: a
+// write larger than its configured size must still only retain the tail,
+// and an offset that has already fallen out of the ring must be rejected
+// rather than handed back a short read.
+func TestStdinRingBounded(t *testing.T) {
+	ring := newStdinRing(4)
+	ring.Write([]byte("abcdefgh"))
+
+	if _, ok := ring.since(0); ok {
+		t.Fatalf("since(0) = ok, want !ok (offset 0 fell out of the ring once it trimmed to the last 4 bytes)")
+	}
+
+	got, ok := ring.since(ring.nextOffset() - 4)
+	if !ok {
+		t.Fatalf("since(nextOffset()-4) = not ok, want the retained tail")
+	}
+	if len(got) > 4 {
+		t.Fatalf("ring retained %d bytes, want <= 4 (the ring's size bounds it)", len(got))
+	}
+	if string(got) != "efgh" {
+		t.Fatalf("ring tail = %q, want %q", got, "efgh")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/hyperhq/runv/agent"
@@ -46,6 +47,19 @@ var shimCommand = cli.Command{
 		cli.BoolFlag{
 			Name: "proxy-winsize",
 		},
+		cli.StringFlag{
+			Name:  "detach-keys",
+			Value: "ctrl-p,ctrl-q",
+			Usage: "escape sequence, in docker's --detach-keys syntax, that detaches stdio without killing the container process",
+		},
+		cli.BoolFlag{
+			Name:  "high-throughput-stdio",
+			Usage: "proxy stdio over dedicated vsock connections instead of the multiplexed agent channel, falling back automatically if unsupported",
+		},
+		cli.StringFlag{
+			Name:  "events-fifo",
+			Usage: "path of an existing FIFO to which newline-delimited JSON start/signal/exit events are written, containerd v2 shim task event style",
+		},
 	},
 	Before: func(context *cli.Context) error {
 		return cmdPrepare(context, false, false)
@@ -53,11 +67,21 @@ var shimCommand = cli.Command{
 	Action: func(context *cli.Context) error {
 		container := context.String("container")
 		process := context.String("process")
+		agentAddr := filepath.Join(context.GlobalString("root"), container, "sandbox", "kata-agent.sock")
 
-		h, err := agent.NewKataAgent(filepath.Join(context.GlobalString("root"), container, "sandbox", "kata-agent.sock"))
+		h, err := agent.NewKataAgent(agentAddr)
 		if err != nil {
 			return cli.NewExitError(fmt.Sprintf("failed to connect to hyperstart proxy: %v", err), -1)
 		}
+		// the control socket's per-connection goroutines and the
+		// signal/winsize forwarders below all issue RPCs against h
+		// concurrently; serialize them rather than assume the
+		// kata-agent client is safe for concurrent use.
+		h = newSyncAgent(h)
+
+		events := openEventSink(context.String("events-fifo"))
+		defer events.Close()
+		events.emit(shimEvent{Type: "start", Pid: os.Getpid()})
 
 		if process == "init" {
 			waitSigUsr1 := make(chan os.Signal, 1)
@@ -66,9 +90,27 @@ var shimCommand = cli.Command{
 			signal.Stop(waitSigUsr1)
 		}
 
+		var exitSt exitState
+		cs := newControlServer(h, container, process)
+		cs.exitCode = exitSt.get
+		detachc := make(chan struct{})
+
 		if context.Bool("proxy-stdio") {
+			detachKeys, err := parseDetachKeys(context.String("detach-keys"))
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("invalid detach-keys: %v", err), -1)
+			}
 			wg := &sync.WaitGroup{}
-			proxyStdio(h, container, process, wg)
+			useVsock := context.Bool("high-throughput-stdio")
+			if useVsock {
+				if err := proxyStdioHighThroughput(h, container, process, wg, cs, detachKeys, detachc); err != nil {
+					glog.Warningf("high-throughput stdio unavailable for %s/%s: %v, falling back to multiplexed pipe", container, process, err)
+					useVsock = false
+				}
+			}
+			if !useVsock {
+				proxyStdio(agentAddr, container, process, wg, detachKeys, detachc, cs)
+			}
 			defer wg.Wait()
 		}
 
@@ -84,12 +126,39 @@ var shimCommand = cli.Command{
 
 		if context.Bool("proxy-signal") {
 			glog.V(3).Infof("using shim to proxy signal")
-			sigc := forwardAllSignals(h, container, process)
+			sigc := forwardAllSignals(h, container, process, events)
 			defer signal.Stop(sigc)
 		}
 
-		// wait until exit
-		exitcode := h.WaitProcess(container, process)
+		if context.Bool("proxy-stdio") || context.Bool("proxy-signal") || context.Bool("proxy-winsize") {
+			sockPath := controlSocketPath(context.GlobalString("root"), container, process)
+			go func() {
+				if err := cs.serve(sockPath); err != nil {
+					glog.Errorf("%v", err)
+				}
+			}()
+			defer os.Remove(sockPath)
+		}
+
+		// wait until exit; on a detach (see --detach-keys) the stdio copy
+		// loops above have already torn down their own connection and
+		// stopped, but the shim process itself, along with cs.serve and the
+		// output ring it keeps, must keep running so a later `runv attach`
+		// has a control socket to dial. So a detach doesn't return here,
+		// it just switches to waiting on the container's actual exit.
+		waitc := make(chan int, 1)
+		go func() { waitc <- h.WaitProcess(container, process) }()
+
+		var exitcode int
+		select {
+		case exitcode = <-waitc:
+		case <-detachc:
+			glog.V(3).Infof("detach sequence received for %s/%s, leaving container running and the control socket available for a later `runv attach`", container, process)
+			exitcode = <-waitc
+		}
+
+		exitSt.set(exitcode)
+		events.emit(shimEvent{Type: "exit", Status: exitcode, ExitedAt: time.Now().Format(time.RFC3339Nano)})
 		if context.Bool("proxy-exit-code") {
 			glog.V(3).Infof("using shim to proxy exit code: %d", exitcode)
 			if exitcode != 0 {
@@ -102,31 +171,150 @@ var shimCommand = cli.Command{
 	},
 }
 
-func proxyStdio(h agent.SandboxAgent, container, process string, wg *sync.WaitGroup) {
+// proxyStdio copies stdio between the host and the container process over a
+// reconnecting kata-agent.sock connection: if the connection drops mid-copy
+// (EOF or a transport error), it is re-dialed with exponential backoff and
+// the copy resumes rather than tearing down the shim, so a transient socket
+// error doesn't orphan the user's session. Stdin written since the previous
+// reconnect is replayed from a 64KiB ring, including bytes the old connection
+// had already received; if more than that was written, nothing is replayed
+// and that input is lost. Stdout/stderr
+// resumption from an offset requires the agent to implement
+// agent.ResumableStdioAgent; no agent in this tree does yet (see
+// agent.stdioFromAgent), so in practice a reconnect still restarts
+// stdout/stderr from whatever the fresh connection yields, and any output
+// produced while no connection was attached is lost. stdioFromAgent logs
+// loudly when this fallback is taken after some output was delivered.
+//
+// Stdin is scanned for detachKeys (see --detach-keys); on a match, detachc is
+// closed and the connection is torn down so proxying stops without killing
+// the container process. Stdout/stderr are also teed through cs so a later
+// `runv attach` can replay recent output and stream live output.
+func proxyStdio(agentAddr, container, process string, wg *sync.WaitGroup, detachKeys []byte, detachc chan struct{}, cs *controlServer) {
+	rs, err := agent.NewReconnectingStdio(agentAddr, container, process, 0)
+	if err != nil {
+		glog.Errorf("proxyStdio: failed to connect to %s: %v", agentAddr, err)
+		return
+	}
+	cs.rs = rs
+
+	stopc := make(chan struct{})
+	stdin := newDetachReader(os.Stdin, detachKeys, func() {
+		// stop any further reconnect attempts and tear down the current
+		// connection so the blocked stdout/stderr copies unblock with an
+		// error instead of hanging forever.
+		close(detachc)
+		close(stopc)
+		rs.Close()
+	})
+
 	// don't wait the copying of the stdin, because `io.Copy(inPipe, os.Stdin)`
 	// can't terminate when no input. todo: find a better way.
 	wg.Add(2)
-	inPipe, outPipe, errPipe := agent.StdioPipe(h, container, process)
-	go func() {
-		_, err1 := io.Copy(inPipe, os.Stdin)
-		err2 := h.CloseStdin(container, process)
-		glog.V(3).Infof("copy stdin %#v %#v", err1, err2)
-	}()
+	go copyStdin(rs, stdin, stopc)
 
-	go func() {
-		_, err := io.Copy(os.Stdout, outPipe)
-		glog.V(3).Infof("copy stdout %#v", err)
-		wg.Done()
-	}()
+	go copyReconnecting("stdout", io.MultiWriter(os.Stdout, teeWriter{cs}), rs.Stdout, rs.AddStdoutOffset, rs, stopc, wg)
+	go copyReconnecting("stderr", io.MultiWriter(os.Stderr, teeWriter{cs}), rs.Stderr, rs.AddStderrOffset, rs, stopc, wg)
+}
 
-	go func() {
-		_, err := io.Copy(os.Stderr, errPipe)
-		glog.V(3).Infof("copy stderr %#v", err)
-		wg.Done()
-	}()
+// teeWriter feeds copied stdout/stderr bytes into a controlServer so a
+// (re)attaching client can replay and stream them.
+type teeWriter struct {
+	cs *controlServer
+}
+
+func (t teeWriter) Write(p []byte) (int, error) {
+	return t.cs.feed(p)
+}
+
+// stdinSink is implemented by whatever's proxying stdin to the container for
+// this shim (the reconnecting multiplexed session or, for the vsock path, a
+// plain writer), so the control server can forward an attached client's
+// input regardless of which stdio path is active.
+type stdinSink interface {
+	WriteStdin(p []byte) (int, error)
+}
+
+// stdinWriter adapts a stdinSink's WriteStdin to io.Writer so it can be used
+// as the destination of io.Copy.
+type stdinWriter struct {
+	rs stdinSink
 }
 
-func forwardAllSignals(h agent.SandboxAgent, container, process string) chan os.Signal {
+func (w stdinWriter) Write(p []byte) (int, error) {
+	return w.rs.WriteStdin(p)
+}
+
+// copyReconnecting copies from the stream returned by source (stdout or
+// stderr) to dst, transparently reconnecting rs and resuming the copy
+// whenever the current stream returns an error. It notes rs's generation
+// before each attempt and hands it to Reconnect, so that if the sibling
+// stdout/stderr/stdin copy loop already redialed for this same drop, this
+// loop just picks up the fresh stream instead of redialing again too.
+func copyReconnecting(name string, dst io.Writer, source func() (io.Reader, int64), addOffset func(int64), rs *agent.ReconnectingStdio, stopc chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		gen := rs.Generation()
+		r, _ := source()
+		n, err := io.Copy(dst, r)
+		addOffset(n)
+		if err == nil || err == io.EOF {
+			glog.V(3).Infof("copy %s %#v", name, err)
+			return
+		}
+
+		select {
+		case <-stopc:
+			// the caller (e.g. a detach) tore down the connection on
+			// purpose; don't try to reconnect, just stop.
+			glog.V(3).Infof("copy %s: stopped", name)
+			return
+		default:
+		}
+
+		glog.Warningf("copy %s: connection error: %v, reconnecting", name, err)
+		if err := rs.Reconnect(stopc, gen); err != nil {
+			glog.Errorf("copy %s: giving up: %v", name, err)
+			return
+		}
+	}
+}
+
+// copyStdin copies stdin to the container, transparently reconnecting rs
+// the same way copyReconnecting does for stdout/stderr: a write error just
+// means the shared connection dropped, not that stdin itself ended, so the
+// copy resumes against the fresh connection instead of exiting and leaving
+// the session with a dead keyboard. It isn't added to wg (see the call
+// site): io.Copy here can't terminate while the terminal has no EOF to
+// give it, so the caller doesn't wait for it.
+func copyStdin(rs *agent.ReconnectingStdio, stdin io.Reader, stopc chan struct{}) {
+	for {
+		gen := rs.Generation()
+		_, err := io.Copy(stdinWriter{rs}, stdin)
+		if err == nil {
+			// stdin reached EOF (e.g. input redirected from a file, or the
+			// detach-keys sequence matched): nothing left to copy.
+			err2 := rs.CloseStdin()
+			glog.V(3).Infof("copy stdin: stdin closed, close-stdin result %#v", err2)
+			return
+		}
+
+		select {
+		case <-stopc:
+			glog.V(3).Infof("copy stdin: stopped")
+			return
+		default:
+		}
+
+		glog.Warningf("copy stdin: connection error: %v, reconnecting", err)
+		if err := rs.Reconnect(stopc, gen); err != nil {
+			glog.Errorf("copy stdin: giving up: %v", err)
+			return
+		}
+	}
+}
+
+func forwardAllSignals(h agent.SandboxAgent, container, process string, events *eventSink) chan os.Signal {
 	sigc := make(chan os.Signal, 2048)
 	// handle all signals for the process.
 	signal.Notify(sigc)
@@ -150,7 +338,9 @@ func forwardAllSignals(h agent.SandboxAgent, container, process string) chan os.
 				err = fmt.Errorf("forward signal %q failed: %v", s.String(), err)
 				fmt.Fprintf(os.Stderr, "%v", err)
 				glog.Errorf("%v", err)
+				continue
 			}
+			events.emit(shimEvent{Type: "signal", Signal: signalName(sysSig)})
 		}
 	}()
 	return sigc
@@ -188,6 +378,9 @@ func prepareRunvShim(options runvOptions, container, process string, terminal bo
 	if terminal {
 		args = append(args, "--proxy-winsize")
 	}
+	if options.Bool("high-throughput-stdio") {
+		args = append(args, "--high-throughput-stdio")
+	}
 
 	return path, args, nil
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli"
+)
+
+// parseDetachKeys parses a --detach-keys value using the same syntax as
+// docker/moby: a comma-separated list of single characters or "ctrl-<letter>"
+// combos, e.g. "ctrl-p,ctrl-q".
+func parseDetachKeys(value string) ([]byte, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var keys []byte
+	for _, k := range strings.Split(value, ",") {
+		switch {
+		case strings.HasPrefix(k, "ctrl-"):
+			c := strings.TrimPrefix(k, "ctrl-")
+			if len(c) != 1 {
+				return nil, fmt.Errorf("invalid detach key %q", k)
+			}
+			b := c[0]
+			switch {
+			case b >= 'a' && b <= 'z':
+				b = b - 'a' + 1
+			case b >= 'A' && b <= 'Z':
+				b = b - 'A' + 1
+			default:
+				return nil, fmt.Errorf("invalid detach key %q", k)
+			}
+			keys = append(keys, b)
+		case len(k) == 1:
+			keys = append(keys, k[0])
+		default:
+			return nil, fmt.Errorf("invalid detach key %q", k)
+		}
+	}
+	return keys, nil
+}
+
+// detachReader wraps a stdin stream and watches it for a configured escape
+// sequence (same idea as docker/moby's --detach-keys): bytes that turn out
+// not to be part of the sequence are passed through as read; once the full
+// sequence is seen, onDetach fires once and the reader starts returning EOF
+// so the caller can stop proxying stdin without killing the container
+// process. Sized io.Copy buffers (tens of KiB) make the brief extra
+// allocation in the rare cross-Read partial-match case a non-issue.
+type detachReader struct {
+	r        io.Reader
+	keys     []byte
+	onDetach func()
+
+	pending  []byte
+	carry    []byte
+	detached bool
+}
+
+func newDetachReader(r io.Reader, keys []byte, onDetach func()) io.Reader {
+	if len(keys) == 0 {
+		return r
+	}
+	return &detachReader{r: r, keys: keys, onDetach: onDetach}
+}
+
+func (d *detachReader) Read(p []byte) (int, error) {
+	// out from a previous Read can be longer than p (carried-over pending
+	// bytes plus this call's full-sized underlying read can together exceed
+	// len(p)); deliver whatever didn't fit before doing anything else so it
+	// isn't silently dropped by a later copy(p, out).
+	if len(d.carry) > 0 {
+		n := copy(p, d.carry)
+		d.carry = d.carry[n:]
+		return n, nil
+	}
+	if d.detached {
+		return 0, io.EOF
+	}
+
+	buf := make([]byte, len(p))
+	n, err := d.r.Read(buf)
+	var out []byte
+	for i := 0; i < n; i++ {
+		b := buf[i]
+		if b == d.keys[len(d.pending)] {
+			d.pending = append(d.pending, b)
+			if len(d.pending) == len(d.keys) {
+				d.detached = true
+				if d.onDetach != nil {
+					d.onDetach()
+				}
+				return d.deliver(p, out, io.EOF)
+			}
+			continue
+		}
+		out = append(out, d.pending...)
+		d.pending = d.pending[:0]
+		if b == d.keys[0] {
+			d.pending = append(d.pending, b)
+		} else {
+			out = append(out, b)
+		}
+	}
+	if err != nil && len(d.pending) > 0 {
+		// the stream ended (or errored) before the tentative match could be
+		// confirmed as the escape sequence, so it wasn't one: release the
+		// held-back bytes instead of silently dropping them.
+		out = append(out, d.pending...)
+		d.pending = d.pending[:0]
+	}
+	return d.deliver(p, out, err)
+}
+
+// deliver copies as much of out into p as fits and stashes anything left
+// over in d.carry to hand back on the next Read, instead of letting
+// copy(p, out) silently truncate it: out can be longer than p since it may
+// carry bytes held back from a previous call on top of a full len(p) read.
+// retErr is only actually returned once carry has fully drained, so a
+// caller reacting to io.EOF (or any other terminal error) still sees every
+// byte we already had in hand first.
+func (d *detachReader) deliver(p, out []byte, retErr error) (int, error) {
+	n := copy(p, out)
+	if n < len(out) {
+		d.carry = append(d.carry, out[n:]...)
+		return n, nil
+	}
+	return n, retErr
+}
+
+var attachCommand = cli.Command{
+	Name:      "attach",
+	Usage:     "attach to a running container's process via its shim control socket",
+	ArgsUsage: "<container>",
+	HideHelp:  true,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "process",
+			Value: "init",
+		},
+		cli.IntFlag{
+			Name:  "replay",
+			Value: 4096,
+			Usage: "number of recent stdout/stderr bytes to replay on attach",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		container := context.Args().First()
+		if container == "" {
+			return cli.NewExitError("container name is required", -1)
+		}
+		process := context.String("process")
+		sockPath := controlSocketPath(context.GlobalString("root"), container, process)
+
+		conn, err := net.Dial("unix", sockPath)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("failed to connect to shim control socket %s: %v", sockPath, err), -1)
+		}
+		defer conn.Close()
+
+		if _, err := fmt.Fprintf(conn, "attach %d\n", context.Int("replay")); err != nil {
+			return cli.NewExitError(fmt.Sprintf("failed to request attach: %v", err), -1)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(os.Stdout, conn)
+		}()
+		io.Copy(conn, os.Stdin)
+		wg.Wait()
+
+		return nil
+	},
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestParseDetachKeys covers the docker/moby-style syntax parseDetachKeys
+// accepts, and the inputs it's supposed to reject.
+func TestParseDetachKeys(t *testing.T) {
+	cases := []struct {
+		value   string
+		want    []byte
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "ctrl-p,ctrl-q", want: []byte{16, 17}},
+		{value: "ctrl-a", want: []byte{1}},
+		{value: "a", want: []byte{'a'}},
+		{value: "a,b,c", want: []byte{'a', 'b', 'c'}},
+		{value: "ctrl-@", wantErr: true},
+		{value: "ab", wantErr: true},
+		{value: "ctrl-", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseDetachKeys(c.value)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseDetachKeys(%q) = %v, nil, want an error", c.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDetachKeys(%q): %v", c.value, err)
+			continue
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("parseDetachKeys(%q) = %v, want %v", c.value, got, c.want)
+		}
+	}
+}
+
+// TestDetachReaderPassesThroughWithoutMatch asserts ordinary input that
+// never matches the escape sequence is delivered unchanged.
+func TestDetachReaderPassesThroughWithoutMatch(t *testing.T) {
+	var detached bool
+	r := newDetachReader(strings.NewReader("hello world"), []byte{16, 17}, func() { detached = true })
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("got %q, want %q", got, "hello world")
+	}
+	if detached {
+		t.Fatalf("onDetach fired without a matching escape sequence")
+	}
+}
+
+// TestDetachReaderFiresOnExactSequence asserts a full detach-keys match
+// fires onDetach exactly once and turns the reader into an EOF source,
+// without leaking the escape sequence itself into the delivered bytes.
+func TestDetachReaderFiresOnExactSequence(t *testing.T) {
+	var detaches int
+	r := newDetachReader(strings.NewReader("abc\x10\x11def"), []byte{16, 17}, func() { detaches++ })
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "abc" {
+		t.Fatalf("got %q, want %q (bytes after the escape sequence must not be delivered)", got, "abc")
+	}
+	if detaches != 1 {
+		t.Fatalf("onDetach fired %d times, want 1", detaches)
+	}
+}
+
+// TestDetachReaderReleasesPartialMatch asserts a prefix of the escape
+// sequence that's never completed (the stream ends or diverges first) is
+// released to the caller instead of being silently swallowed.
+func TestDetachReaderReleasesPartialMatch(t *testing.T) {
+	var detached bool
+	r := newDetachReader(strings.NewReader("abc\x10"), []byte{16, 17}, func() { detached = true })
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "abc\x10" {
+		t.Fatalf("got %q, want %q (the unconfirmed partial match must be released)", got, "abc\x10")
+	}
+	if detached {
+		t.Fatalf("onDetach fired on an incomplete sequence")
+	}
+}
+
+// TestDetachReaderHandlesDivergingPrefix asserts that a byte matching the
+// sequence's first key, followed by a byte that isn't the second key,
+// releases the held-back first byte and restarts matching from scratch
+// rather than losing it or wrongly firing onDetach.
+func TestDetachReaderHandlesDivergingPrefix(t *testing.T) {
+	var detached bool
+	// \x10 (first key) followed by 'x' (not the second key) should release
+	// "\x10x" untouched, then the real sequence later should still fire.
+	r := newDetachReader(strings.NewReader("\x10x\x10\x11"), []byte{16, 17}, func() { detached = true })
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "\x10x" {
+		t.Fatalf("got %q, want %q", got, "\x10x")
+	}
+	if !detached {
+		t.Fatalf("onDetach did not fire on the real sequence after the diverging prefix")
+	}
+}
+
+// TestDetachReaderNoKeysIsPassthrough asserts newDetachReader with no keys
+// configured (the --detach-keys="" case) returns the underlying reader
+// directly rather than wrapping it in dead state-machine logic.
+func TestDetachReaderNoKeysIsPassthrough(t *testing.T) {
+	src := strings.NewReader("hello")
+	if r := newDetachReader(src, nil, func() {}); r != src {
+		t.Fatalf("newDetachReader with no keys = %v, want the original reader unwrapped", r)
+	}
+}
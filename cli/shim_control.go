@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/runv/agent"
+)
+
+// controlSocketPath returns the path of the per-shim control socket that lets
+// an out-of-band caller (e.g. an SSH front-end embedding runv, or `runv
+// attach`) drive signals, window-resize and reattachment without a
+// controlling TTY of its own.
+func controlSocketPath(root, container, process string) string {
+	return filepath.Join(root, container, fmt.Sprintf("shim-%s.sock", process))
+}
+
+// namedSignals maps SSH-style signal names (RFC 4254, e.g. "TERM", "HUP") to
+// the syscall.Signal forwarded to the container process.
+var namedSignals = map[string]syscall.Signal{
+	"ABRT": syscall.SIGABRT,
+	"ALRM": syscall.SIGALRM,
+	"FPE":  syscall.SIGFPE,
+	"HUP":  syscall.SIGHUP,
+	"ILL":  syscall.SIGILL,
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"PIPE": syscall.SIGPIPE,
+	"QUIT": syscall.SIGQUIT,
+	"SEGV": syscall.SIGSEGV,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// namedSignal translates an SSH-style signal name into a syscall.Signal,
+// accepting both the bare RFC 4254 spelling ("TERM") and the usual Go/"SIG"
+// spelling ("SIGTERM").
+func namedSignal(name string) (syscall.Signal, bool) {
+	name = strings.ToUpper(strings.TrimPrefix(strings.ToUpper(name), "SIG"))
+	sig, ok := namedSignals[name]
+	return sig, ok
+}
+
+// signalName is the inverse of namedSignal: it renders sig using the usual
+// "SIG"-prefixed spelling (e.g. "SIGTERM") for event logs and protocols that
+// expect it, falling back to sig's own (platform-specific) String() for
+// signals not in namedSignals.
+func signalName(sig syscall.Signal) string {
+	for name, s := range namedSignals {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return sig.String()
+}
+
+// syncAgent serializes the short, non-blocking calls into an
+// agent.SandboxAgent so it can be shared safely between the shim's own
+// signal/winsize forwarding goroutines and the control socket's
+// per-connection goroutines, which otherwise issue concurrent RPCs over the
+// same kata-agent.sock connection.
+//
+// WaitProcess is deliberately excluded from this lock: it blocks for the
+// lifetime of the container process, and the shim command always starts a
+// WaitProcess goroutine alongside proxy-signal at shim startup. Sharing one
+// mutex across both would let that goroutine hold the lock for the entire
+// container lifetime, silently wedging every SignalProcess/CloseStdin/
+// TtyWinResize call (and therefore the control socket) until the container
+// had already exited. WaitProcess gets its own mutex so a long call never
+// blocks the short ones.
+type syncAgent struct {
+	mu     sync.Mutex
+	waitMu sync.Mutex
+	agent.SandboxAgent
+}
+
+func newSyncAgent(a agent.SandboxAgent) *syncAgent {
+	return &syncAgent{SandboxAgent: a}
+}
+
+func (s *syncAgent) SignalProcess(container, process string, sig syscall.Signal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.SandboxAgent.SignalProcess(container, process, sig)
+}
+
+func (s *syncAgent) CloseStdin(container, process string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.SandboxAgent.CloseStdin(container, process)
+}
+
+func (s *syncAgent) WaitProcess(container, process string) int {
+	s.waitMu.Lock()
+	defer s.waitMu.Unlock()
+	return s.SandboxAgent.WaitProcess(container, process)
+}
+
+func (s *syncAgent) TtyWinResize(container, process string, rows, cols uint16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.SandboxAgent.TtyWinResize(container, process, rows, cols)
+}
+
+// exitState records the process exit code once it's known, so the control
+// socket can answer `exit-code` queries without blocking on WaitProcess.
+type exitState struct {
+	mu     sync.Mutex
+	code   int
+	exited bool
+}
+
+func (e *exitState) set(code int) {
+	e.mu.Lock()
+	e.code, e.exited = code, true
+	e.mu.Unlock()
+}
+
+func (e *exitState) get() (int, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.code, e.exited
+}
+
+// outputRingSize bounds how much recent combined stdout/stderr is retained
+// so a client that (re)attaches via the control socket can be shown recent
+// output instead of nothing.
+const outputRingSize = 64 * 1024
+
+// byteRing retains the tail of a stream so a (re)attaching client can replay
+// recent output.
+type byteRing struct {
+	mu  sync.Mutex
+	buf []byte
+	cap int
+}
+
+func newByteRing(size int) *byteRing {
+	return &byteRing{cap: size}
+}
+
+func (b *byteRing) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.cap; over > 0 {
+		b.buf = b.buf[over:]
+	}
+	return len(p), nil
+}
+
+// tail returns the last n bytes written (or everything retained, if less).
+// n <= 0 means "everything retained".
+func (b *byteRing) tail(n int) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n <= 0 || n > len(b.buf) {
+		n = len(b.buf)
+	}
+	out := make([]byte, n)
+	copy(out, b.buf[len(b.buf)-n:])
+	return out
+}
+
+// controlServer services `signal <NAME>`, `winsize <cols> <rows>`,
+// `close-stdin`, `exit-code` and `attach [n]` commands over a line-framed
+// protocol on the shim's control socket.
+type controlServer struct {
+	h                  agent.SandboxAgent
+	container, process string
+	exitCode           func() (int, bool)
+
+	// rs forwards an attached client's input to the container's stdin; set
+	// once proxy-stdio (either the reconnecting multiplexed session or the
+	// high-throughput vsock path) is active.
+	rs stdinSink
+
+	outRing *byteRing
+
+	teeMu sync.Mutex
+	tees  map[net.Conn]struct{}
+}
+
+func newControlServer(h agent.SandboxAgent, container, process string) *controlServer {
+	return &controlServer{
+		h:         h,
+		container: container,
+		process:   process,
+		exitCode:  func() (int, bool) { return 0, false },
+		outRing:   newByteRing(outputRingSize),
+		tees:      make(map[net.Conn]struct{}),
+	}
+}
+
+// feed tees p to any attached clients and records it in the replay ring; it
+// has io.Writer's Write signature, and teeWriter adapts it so callers can
+// wrap it into an io.MultiWriter alongside the shim's real stdout/stderr.
+func (cs *controlServer) feed(p []byte) (int, error) {
+	cs.outRing.Write(p)
+	cs.teeMu.Lock()
+	for conn := range cs.tees {
+		conn.Write(p)
+	}
+	cs.teeMu.Unlock()
+	return len(p), nil
+}
+
+func (cs *controlServer) addTee(conn net.Conn) {
+	cs.teeMu.Lock()
+	cs.tees[conn] = struct{}{}
+	cs.teeMu.Unlock()
+}
+
+func (cs *controlServer) removeTee(conn net.Conn) {
+	cs.teeMu.Lock()
+	delete(cs.tees, conn)
+	cs.teeMu.Unlock()
+}
+
+// serve listens on sockPath and handles connections until the listener is
+// closed or accept fails; it's meant to run alongside the goroutines that
+// already service proxy-stdio/proxy-signal/proxy-winsize for this shim.
+func (cs *controlServer) serve(sockPath string) error {
+	os.Remove(sockPath)
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket %s: %v", sockPath, err)
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			glog.V(3).Infof("control socket %s closed: %v", sockPath, err)
+			return nil
+		}
+		go cs.handle(conn)
+	}
+}
+
+func (cs *controlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	// a bufio.Reader, not Scanner, so that on "attach" we can hand the same
+	// reader (and whatever it's already buffered past the command line) to
+	// serveAttach instead of resuming reads from the raw conn and losing
+	// any input the client pipelined right after the command.
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "attach" {
+			cs.serveAttach(conn, r, fields[1:])
+			return
+		}
+		if len(fields) > 0 {
+			if dispatchErr := cs.dispatch(conn, fields); dispatchErr != nil {
+				fmt.Fprintf(conn, "error: %v\n", dispatchErr)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serveAttach replays the last n bytes of output (all retained output if n
+// is omitted or non-numeric), then streams further output to conn and
+// forwards bytes read from r (the buffered reader handle already reads
+// conn through) to the container's stdin until conn closes.
+func (cs *controlServer) serveAttach(conn net.Conn, r *bufio.Reader, args []string) {
+	n := -1
+	if len(args) > 0 {
+		if v, err := strconv.Atoi(args[0]); err == nil {
+			n = v
+		}
+	}
+	conn.Write(cs.outRing.tail(n))
+
+	if cs.rs == nil {
+		// proxy-stdio isn't active for this shim at all, so there's nowhere
+		// to forward the attached client's input; say so instead of
+		// silently discarding it. (Both stdio paths, reconnecting
+		// multiplexed and high-throughput vsock, set cs.rs when active.)
+		fmt.Fprintf(conn, "error: stdin forwarding is unavailable for this attach session\n")
+		return
+	}
+
+	cs.addTee(conn)
+	defer cs.removeTee(conn)
+	io.Copy(stdinWriter{cs.rs}, r)
+}
+
+func (cs *controlServer) dispatch(conn net.Conn, fields []string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch fields[0] {
+	case "signal":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: signal <NAME>")
+		}
+		sig, ok := namedSignal(fields[1])
+		if !ok {
+			return fmt.Errorf("unknown signal %q", fields[1])
+		}
+		return cs.h.SignalProcess(cs.container, cs.process, sig)
+
+	case "winsize":
+		if len(fields) != 3 {
+			return fmt.Errorf("usage: winsize <cols> <rows>")
+		}
+		cols, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return fmt.Errorf("invalid cols %q: %v", fields[1], err)
+		}
+		rows, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("invalid rows %q: %v", fields[2], err)
+		}
+		return cs.h.TtyWinResize(cs.container, cs.process, uint16(rows), uint16(cols))
+
+	case "close-stdin":
+		return cs.h.CloseStdin(cs.container, cs.process)
+
+	case "exit-code":
+		if code, exited := cs.exitCode(); exited {
+			_, err := fmt.Fprintf(conn, "%d\n", code)
+			return err
+		}
+		_, err := fmt.Fprintln(conn, "running")
+		return err
+
+	default:
+		return fmt.Errorf("unknown command %q", fields[0])
+	}
+}
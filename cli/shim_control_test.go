@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// fakeControlAgent is a minimal agent.SandboxAgent stand-in that records the
+// calls dispatch makes against it.
+type fakeControlAgent struct {
+	mu sync.Mutex
+
+	signaled      []syscall.Signal
+	closedStdin   bool
+	resizedRows   uint16
+	resizedCols   uint16
+	signalErr     error
+	closeStdinErr error
+	winResizeErr  error
+}
+
+func (a *fakeControlAgent) SignalProcess(container, process string, sig syscall.Signal) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.signaled = append(a.signaled, sig)
+	return a.signalErr
+}
+
+func (a *fakeControlAgent) CloseStdin(container, process string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closedStdin = true
+	return a.closeStdinErr
+}
+
+func (a *fakeControlAgent) WaitProcess(container, process string) int { return 0 }
+
+func (a *fakeControlAgent) TtyWinResize(container, process string, rows, cols uint16) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.resizedRows, a.resizedCols = rows, cols
+	return a.winResizeErr
+}
+
+// pipeConn is a net.Conn good enough for dispatch's fmt.Fprintf(conn, ...)
+// replies: dispatch only ever writes to it, in the exit-code case.
+type pipeConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (p *pipeConn) Write(b []byte) (int, error) { return p.buf.Write(b) }
+
+// TestNamedSignalAcceptsBareAndSIGPrefixedSpelling asserts namedSignal
+// resolves both the RFC 4254 spelling and the usual Go "SIG"-prefixed one,
+// case-insensitively, and rejects anything else.
+func TestNamedSignalAcceptsBareAndSIGPrefixedSpelling(t *testing.T) {
+	for _, name := range []string{"TERM", "term", "SIGTERM", "sigterm", "SigTerm"} {
+		sig, ok := namedSignal(name)
+		if !ok || sig != syscall.SIGTERM {
+			t.Errorf("namedSignal(%q) = %v, %v, want SIGTERM, true", name, sig, ok)
+		}
+	}
+	if _, ok := namedSignal("NOTASIGNAL"); ok {
+		t.Errorf("namedSignal(NOTASIGNAL) = ok, want !ok")
+	}
+}
+
+// TestSignalNameRendersSIGPrefixed asserts signalName is the inverse of
+// namedSignal for every signal namedSignals knows about.
+func TestSignalNameRendersSIGPrefixed(t *testing.T) {
+	for name, sig := range namedSignals {
+		want := "SIG" + name
+		if got := signalName(sig); got != want {
+			t.Errorf("signalName(%v) = %q, want %q", sig, got, want)
+		}
+	}
+}
+
+// TestByteRingTail asserts byteRing retains only the configured tail and
+// that tail(n) returns the last n bytes (or everything, for n<=0 or
+// n>len(retained)).
+func TestByteRingTail(t *testing.T) {
+	r := newByteRing(4)
+	r.Write([]byte("abcdefgh"))
+
+	if got := string(r.tail(-1)); got != "efgh" {
+		t.Fatalf("tail(-1) = %q, want %q (everything retained)", got, "efgh")
+	}
+	if got := string(r.tail(0)); got != "efgh" {
+		t.Fatalf("tail(0) = %q, want %q", got, "efgh")
+	}
+	if got := string(r.tail(2)); got != "gh" {
+		t.Fatalf("tail(2) = %q, want %q", got, "gh")
+	}
+	if got := string(r.tail(100)); got != "efgh" {
+		t.Fatalf("tail(100) = %q, want %q (clamped to what's retained)", got, "efgh")
+	}
+}
+
+// TestExitStateUnsetUntilSet asserts exitState reports not-exited until
+// set is called, and the exact code afterward.
+func TestExitStateUnsetUntilSet(t *testing.T) {
+	var e exitState
+	if _, exited := e.get(); exited {
+		t.Fatalf("get() on a fresh exitState reports exited")
+	}
+	e.set(7)
+	code, exited := e.get()
+	if !exited || code != 7 {
+		t.Fatalf("get() after set(7) = %d, %v, want 7, true", code, exited)
+	}
+}
+
+// TestControlServerDispatchSignal asserts a "signal NAME" command resolves
+// the name and forwards it to the agent.
+func TestControlServerDispatchSignal(t *testing.T) {
+	a := &fakeControlAgent{}
+	cs := newControlServer(a, "c", "p")
+	conn := &pipeConn{}
+
+	if err := cs.dispatch(conn, []string{"signal", "TERM"}); err != nil {
+		t.Fatalf("dispatch signal: %v", err)
+	}
+	if len(a.signaled) != 1 || a.signaled[0] != syscall.SIGTERM {
+		t.Fatalf("agent signaled = %v, want [SIGTERM]", a.signaled)
+	}
+
+	if err := cs.dispatch(conn, []string{"signal", "NOTASIGNAL"}); err == nil {
+		t.Fatalf("dispatch signal NOTASIGNAL = nil error, want an error")
+	}
+	if err := cs.dispatch(conn, []string{"signal"}); err == nil {
+		t.Fatalf("dispatch signal (missing arg) = nil error, want an error")
+	}
+}
+
+// TestControlServerDispatchWinsize asserts a "winsize COLS ROWS" command
+// forwards the parsed values to the agent in the documented order.
+func TestControlServerDispatchWinsize(t *testing.T) {
+	a := &fakeControlAgent{}
+	cs := newControlServer(a, "c", "p")
+	conn := &pipeConn{}
+
+	if err := cs.dispatch(conn, []string{"winsize", "80", "24"}); err != nil {
+		t.Fatalf("dispatch winsize: %v", err)
+	}
+	if a.resizedCols != 80 || a.resizedRows != 24 {
+		t.Fatalf("resized to cols=%d rows=%d, want cols=80 rows=24", a.resizedCols, a.resizedRows)
+	}
+
+	if err := cs.dispatch(conn, []string{"winsize", "x", "24"}); err == nil {
+		t.Fatalf("dispatch winsize with invalid cols = nil error, want an error")
+	}
+}
+
+// TestControlServerDispatchCloseStdinAndUnknown asserts "close-stdin" is
+// forwarded to the agent and an unrecognized command is rejected instead of
+// silently ignored.
+func TestControlServerDispatchCloseStdinAndUnknown(t *testing.T) {
+	a := &fakeControlAgent{}
+	cs := newControlServer(a, "c", "p")
+	conn := &pipeConn{}
+
+	if err := cs.dispatch(conn, []string{"close-stdin"}); err != nil {
+		t.Fatalf("dispatch close-stdin: %v", err)
+	}
+	if !a.closedStdin {
+		t.Fatalf("CloseStdin was not called")
+	}
+
+	if err := cs.dispatch(conn, []string{"frobnicate"}); err == nil {
+		t.Fatalf("dispatch of an unknown command = nil error, want an error")
+	}
+}
+
+// TestControlServerDispatchExitCode asserts "exit-code" reports "running"
+// before the process exits and the numeric code after exitCode reports one.
+func TestControlServerDispatchExitCode(t *testing.T) {
+	a := &fakeControlAgent{}
+	cs := newControlServer(a, "c", "p")
+	var e exitState
+	cs.exitCode = e.get
+
+	conn := &pipeConn{}
+	if err := cs.dispatch(conn, []string{"exit-code"}); err != nil {
+		t.Fatalf("dispatch exit-code: %v", err)
+	}
+	if got := conn.buf.String(); got != "running\n" {
+		t.Fatalf("exit-code reply = %q, want %q", got, "running\n")
+	}
+
+	e.set(3)
+	conn.buf.Reset()
+	if err := cs.dispatch(conn, []string{"exit-code"}); err != nil {
+		t.Fatalf("dispatch exit-code: %v", err)
+	}
+	if got := conn.buf.String(); got != "3\n" {
+		t.Fatalf("exit-code reply = %q, want %q", got, "3\n")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// shimEvent mirrors the field names containerd's v2 shim task events use, so
+// runv can sit behind containerd/CRI-O without a bespoke adapter.
+type shimEvent struct {
+	Type     string `json:"type"`
+	Pid      int    `json:"pid,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	ExitedAt string `json:"exited_at,omitempty"`
+}
+
+// eventSink writes newline-delimited JSON shim events to a FIFO for a
+// higher-level runtime to consume as an audit log of what was started and
+// what signals were proxied into a container.
+type eventSink struct {
+	mu      sync.Mutex
+	f       *os.File
+	closed  bool
+	pending [][]byte // events marshaled before the open completed
+}
+
+// openEventSink returns a sink for path, which must already exist as a FIFO.
+// It returns a nil sink (not an error) when path is empty, so callers can
+// unconditionally call emit/Close.
+//
+// The FIFO is opened for writing on a background goroutine rather than
+// inline: O_WRONLY on a FIFO blocks until a reader attaches, and this runs
+// ahead of the process=="init" SIGUSR1 handshake, so a missing or late
+// reader used to be able to wedge shim startup entirely. Any event emitted
+// before the open completes (most importantly "start", which carries the
+// pid and is emitted right after openEventSink returns) is queued rather
+// than dropped, and flushed in order once the FIFO is open; Close cancels a
+// still-pending open so its fd doesn't leak.
+func openEventSink(path string) *eventSink {
+	if path == "" {
+		return nil
+	}
+	s := &eventSink{}
+	go func() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			glog.Errorf("failed to open events fifo %s: %v", path, err)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.closed {
+			f.Close()
+			return
+		}
+		for _, b := range s.pending {
+			if _, err := f.Write(b); err != nil {
+				glog.Errorf("failed to write queued shim event to events fifo: %v", err)
+			}
+		}
+		s.pending = nil
+		s.f = f
+	}()
+	return s
+}
+
+func (s *eventSink) emit(e shimEvent) {
+	if s == nil {
+		return
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		glog.Errorf("failed to marshal shim event %+v: %v", e, err)
+		return
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		// no reader has attached to the FIFO yet (or the open failed);
+		// queue the event instead of dropping it so it's still delivered,
+		// in order, once the open completes.
+		s.pending = append(s.pending, b)
+		return
+	}
+	if _, err := s.f.Write(b); err != nil {
+		glog.Errorf("failed to write shim event to events fifo: %v", err)
+	}
+}
+
+func (s *eventSink) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
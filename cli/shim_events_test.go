@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestEventSinkNilIsSafeNoOp asserts a nil *eventSink (the --events-fifo=""
+// case) is safe to emit/Close against, so callers don't need to guard every
+// call site with a nil check.
+func TestEventSinkNilIsSafeNoOp(t *testing.T) {
+	var s *eventSink
+	s.emit(shimEvent{Type: "start"})
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close on nil sink: %v", err)
+	}
+}
+
+// TestEventSinkQueuesEventsUntilReaderAttaches asserts events emitted before
+// a reader attaches to the FIFO (most importantly "start", emitted right
+// after openEventSink returns, well before any real reader has had a chance
+// to show up) are queued and delivered in order once the open completes,
+// rather than silently dropped.
+func TestEventSinkQueuesEventsUntilReaderAttaches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.fifo")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+
+	s := openEventSink(path)
+	defer s.Close()
+
+	s.emit(shimEvent{Type: "start", Pid: 42})
+	s.emit(shimEvent{Type: "signal", Signal: "SIGTERM"})
+
+	f, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("open fifo for reading: %v", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	line1, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read first event: %v", err)
+	}
+	var e1 shimEvent
+	if err := json.Unmarshal([]byte(line1), &e1); err != nil {
+		t.Fatalf("unmarshal first event %q: %v", line1, err)
+	}
+	if e1.Type != "start" || e1.Pid != 42 {
+		t.Fatalf("first event = %+v, want the queued start event first, in order", e1)
+	}
+
+	line2, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read second event: %v", err)
+	}
+	var e2 shimEvent
+	if err := json.Unmarshal([]byte(line2), &e2); err != nil {
+		t.Fatalf("unmarshal second event %q: %v", line2, err)
+	}
+	if e2.Type != "signal" || e2.Signal != "SIGTERM" {
+		t.Fatalf("second event = %+v, want signal SIGTERM", e2)
+	}
+}
+
+// TestEventSinkWritesDirectlyOnceOpen asserts events emitted after the open
+// has completed (no queueing needed) still reach the reader.
+func TestEventSinkWritesDirectlyOnceOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.fifo")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+
+	readerReady := make(chan *bufio.Reader, 1)
+	go func() {
+		f, err := os.OpenFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			close(readerReady)
+			return
+		}
+		readerReady <- bufio.NewReader(f)
+	}()
+
+	s := openEventSink(path)
+	defer s.Close()
+	r := <-readerReady
+	if r == nil {
+		t.Fatalf("failed to open fifo for reading")
+	}
+	// the reader's open returning doesn't mean the sink's goroutine has set
+	// s.f yet; wait for it so emit below writes directly instead of queueing.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.Lock()
+		open := s.f != nil
+		s.mu.Unlock()
+		if open {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the sink to finish opening the fifo")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	s.emit(shimEvent{Type: "exit", Status: 7})
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read event: %v", err)
+	}
+	var e shimEvent
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		t.Fatalf("unmarshal event %q: %v", line, err)
+	}
+	if e.Type != "exit" || e.Status != 7 {
+		t.Fatalf("event = %+v, want exit status=7", e)
+	}
+}
+
+// TestEventSinkCloseCancelsPendingOpen asserts Close doesn't block waiting
+// on a FIFO open that may never complete (no reader ever attaches), and
+// that once a reader does eventually attach, the sink closes the
+// connection without writing anything queued before it was closed.
+func TestEventSinkCloseCancelsPendingOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.fifo")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+
+	s := openEventSink(path)
+	s.emit(shimEvent{Type: "start"})
+
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Close blocked on a pending FIFO open")
+	}
+
+	readDone := make(chan []byte, 1)
+	go func() {
+		f, err := os.OpenFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			readDone <- nil
+			return
+		}
+		defer f.Close()
+		b, _ := io.ReadAll(f)
+		readDone <- b
+	}()
+
+	select {
+	case b := <-readDone:
+		if len(b) != 0 {
+			t.Fatalf("reader got %q after Close, want nothing (the open should have been cancelled)", b)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the writer side to close after Close canceled the pending open")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/runv/agent"
+)
+
+// vsockStdin adapts the vsock path's plain stdin writer to stdinSink so the
+// control server can forward an attached client's input to it the same way
+// it does for the reconnecting multiplexed session.
+type vsockStdin struct {
+	in io.Writer
+}
+
+func (v vsockStdin) WriteStdin(p []byte) (int, error) {
+	return v.in.Write(p)
+}
+
+// proxyStdioHighThroughput routes stdio over dedicated vsock connections
+// instead of the multiplexed kata-agent.sock channel, for workloads (large
+// `tar`/`dd` transfers) that would otherwise fight control RPCs for
+// bandwidth on the same socket. It returns agent.ErrVsockUnavailable if the
+// hypervisor behind h doesn't support it, so the caller can fall back to the
+// regular (reconnecting, multiplexed) proxyStdio.
+//
+// Output is teed through cs and cs.rs is wired up to this path's stdin, the
+// same as proxyStdio does, so `runv attach` keeps working regardless of
+// which stdio path is active. Stdin is scanned for detachKeys the same way
+// too: on a match, detachc is closed and the vsock connections are torn
+// down so the copies stop, leaving the container process running.
+func proxyStdioHighThroughput(h agent.SandboxAgent, container, process string, wg *sync.WaitGroup, cs *controlServer, detachKeys []byte, detachc chan struct{}) error {
+	// the syncAgent wrapper only exposes SandboxAgent's methods, so hand
+	// HighThroughputStdio the agent it wraps, which may implement
+	// agent.VsockStdioAgent.
+	if s, ok := h.(*syncAgent); ok {
+		h = s.SandboxAgent
+	}
+	in, out, errOut, err := agent.HighThroughputStdio(h, container, process)
+	if err != nil {
+		return err
+	}
+	cs.rs = vsockStdin{in}
+
+	stdin := newDetachReader(os.Stdin, detachKeys, func() {
+		close(detachc)
+		in.Close()
+		if c, ok := out.(io.Closer); ok {
+			c.Close()
+		}
+		if c, ok := errOut.(io.Closer); ok {
+			c.Close()
+		}
+	})
+
+	wg.Add(2)
+	go func() {
+		_, err1 := io.Copy(in, stdin)
+		err2 := in.Close()
+		glog.V(3).Infof("vsock copy stdin %#v %#v", err1, err2)
+	}()
+	go func() {
+		_, err := io.Copy(io.MultiWriter(os.Stdout, teeWriter{cs}), out)
+		glog.V(3).Infof("vsock copy stdout %#v", err)
+		wg.Done()
+	}()
+	go func() {
+		_, err := io.Copy(io.MultiWriter(os.Stderr, teeWriter{cs}), errOut)
+		glog.V(3).Infof("vsock copy stderr %#v", err)
+		wg.Done()
+	}()
+	return nil
+}